@@ -0,0 +1,87 @@
+package local
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/drud/bootstrap/local/errdefs"
+)
+
+// AppTypeDriver knows how to detect a given app type on disk and contribute
+// its docker-compose fragment, including any pre-/post-import hooks its
+// restore process needs (see Hook and ddevHooksKey in hooks.go). Third
+// parties can add drivers for Backdrop, TYPO3, Symfony, Laravel, etc.
+// without patching core by calling RegisterAppType from an init().
+type AppTypeDriver interface {
+	// Name returns the app type's identifier, e.g. "drupal" or "wp".
+	Name() string
+	// Detect reports whether basePath looks like this app type.
+	Detect(basePath string) bool
+	// ComposeFragment returns the YAML this app type contributes to the
+	// rendered docker-compose.yaml for app. It's merged into the document
+	// (see withDDEVLabels), so it may be a full "services: ..." document
+	// contributing one or more additional services, and/or a top-level
+	// x-ddev-hooks key declaring RestoreApp's pre-/post-import hooks.
+	ComposeFragment(app App) (string, error)
+}
+
+// appTypeDrivers holds every driver registered via RegisterAppType, keyed
+// by its Name().
+var appTypeDrivers = map[string]AppTypeDriver{}
+
+// RegisterAppType makes a driver available to DetermineAppType and
+// WriteLocalAppYAML. It's meant to be called from a driver package's
+// init().
+func RegisterAppType(driver AppTypeDriver) {
+	appTypeDrivers[driver.Name()] = driver
+}
+
+// DetermineAppType asks every registered driver whether basePath looks like
+// its app type.
+func DetermineAppType(basePath string) (string, error) {
+	for name, driver := range appTypeDrivers {
+		if driver.Detect(basePath) {
+			return name, nil
+		}
+	}
+
+	return "", errdefs.NotFound(fmt.Errorf("couldn't determine app's type"))
+}
+
+func init() {
+	RegisterAppType(drupalAppTypeDriver{})
+	RegisterAppType(wordpressAppTypeDriver{})
+}
+
+// drupalAppTypeDriver is the built-in AppTypeDriver for Drupal sites.
+type drupalAppTypeDriver struct{}
+
+func (drupalAppTypeDriver) Name() string { return "drupal" }
+
+func (drupalAppTypeDriver) Detect(basePath string) bool {
+	return FileExists(path.Join(basePath, "src", "docroot/scripts/drupal.sh"))
+}
+
+func (drupalAppTypeDriver) ComposeFragment(app App) (string, error) {
+	return "", nil
+}
+
+// wordpressAppTypeDriver is the built-in AppTypeDriver for WordPress sites.
+type wordpressAppTypeDriver struct{}
+
+func (wordpressAppTypeDriver) Name() string { return "wp" }
+
+func (wordpressAppTypeDriver) Detect(basePath string) bool {
+	return FileExists(path.Join(basePath, "src", "docroot/wp"))
+}
+
+func (wordpressAppTypeDriver) ComposeFragment(app App) (string, error) {
+	// A post-import x-ddev-hooks entry running `wp search-replace
+	// <old-url> <new-url> --all-tables --skip-columns=guid` belongs here,
+	// but wp search-replace requires those two positional URL arguments and
+	// neither BackupManifest nor App models the site's URL yet. Declaring
+	// the hook without them would make every WordPress restore fail at this
+	// step despite a successful DB import, so this is explicitly descoped
+	// until there's a source for the old/new URLs - not silently omitted.
+	return "", nil
+}
@@ -0,0 +1,520 @@
+package local
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/drud/drud-go/utils"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// BackupManifest describes the contents of a backup tarball so RestoreApp
+// can validate it against the app it's being restored into.
+type BackupManifest struct {
+	AppName     string    `json:"app_name"`
+	Environment string    `json:"environment"`
+	AppType     string    `json:"app_type"`
+	GitCommit   string    `json:"git_commit"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// manifestFileName is the name of the manifest entry written into every
+// backup tarball.
+const manifestFileName = "manifest.json"
+
+// dbDumpFileName is the name of the compressed SQL dump entry written into
+// every backup tarball.
+const dbDumpFileName = "db.sql.gz"
+
+// filesDirName is the tar prefix under which the app's files/ tree is stored.
+const filesDirName = "files"
+
+// BackupApp snapshots a running site into a single tarball at dest,
+// containing a gzipped mysqldump of the -db container, the app's files/
+// tree, and a manifest.json describing the app.
+func BackupApp(app App, dest string) error {
+	homedir, err := utils.GetHomeDir()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	basePath := path.Join(homedir, ".drud", app.RelPath())
+
+	appType, err := DetermineAppType(basePath)
+	if err != nil {
+		return err
+	}
+
+	name, env := appIdentity(app)
+
+	manifest := BackupManifest{
+		AppName:     name,
+		Environment: env,
+		AppType:     appType,
+		GitCommit:   gitCommit(path.Join(basePath, "src")),
+		CreatedAt:   time.Now(),
+	}
+
+	if err := writeBackupTarball(app, basePath, manifest, dest); err != nil {
+		os.Remove(dest)
+		return err
+	}
+
+	return nil
+}
+
+// writeBackupTarball does the actual tar/gzip writing for BackupApp. It's
+// split out so BackupApp can remove a partial dest file if anything here
+// fails, including a flush error on Close.
+func writeBackupTarball(app App, basePath string, manifest BackupManifest, dest string) (err error) {
+	f, ferr := os.Create(dest)
+	if ferr != nil {
+		return fmt.Errorf("could not create backup file: %s", ferr.Error())
+	}
+	defer func() {
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = fmt.Errorf("could not finalize backup file: %s", cerr.Error())
+		}
+	}()
+
+	gzw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gzw)
+
+	dump, derr := dumpDatabase(app)
+	if derr != nil {
+		return fmt.Errorf("could not dump database: %s", derr.Error())
+	}
+	defer os.Remove(dump)
+
+	if err = addFileToTar(tw, dump, dbDumpFileName); err != nil {
+		return err
+	}
+
+	if err = addDirToTar(tw, path.Join(basePath, "files"), filesDirName); err != nil {
+		return err
+	}
+
+	manifestJSON, merr := json.MarshalIndent(manifest, "", "  ")
+	if merr != nil {
+		return merr
+	}
+
+	if err = addBytesToTar(tw, manifestJSON, manifestFileName); err != nil {
+		return err
+	}
+
+	if err = tw.Close(); err != nil {
+		return fmt.Errorf("could not finalize backup tarball: %s", err.Error())
+	}
+
+	if err = gzw.Close(); err != nil {
+		return fmt.Errorf("could not finalize backup tarball: %s", err.Error())
+	}
+
+	return nil
+}
+
+// RestoreApp restores a site from a tarball produced by BackupApp, validating
+// the manifest's app type against DetermineAppType before importing the SQL
+// dump and rsyncing files back.
+func RestoreApp(app App, src string) error {
+	homedir, err := utils.GetHomeDir()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	basePath := path.Join(homedir, ".drud", app.RelPath())
+
+	appType, err := DetermineAppType(basePath)
+	if err != nil {
+		return err
+	}
+
+	workDir, err := os.MkdirTemp("", "drud-restore-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workDir)
+
+	manifest, err := extractBackup(src, workDir)
+	if err != nil {
+		return err
+	}
+
+	if manifest.AppType != appType {
+		return fmt.Errorf("backup app type %q does not match %q", manifest.AppType, appType)
+	}
+
+	// Hooks are declared in docker-compose.yaml's x-ddev-hooks, written by
+	// WriteLocalAppYAML from the app type's ComposeFragment (see hooks.go),
+	// rather than called through the AppTypeDriver directly, so a hook
+	// doesn't depend on DetermineAppType having matched the same driver
+	// that wrote the file.
+	composeYAML, err := os.ReadFile(path.Join(basePath, "docker-compose.yaml"))
+	if err != nil {
+		return fmt.Errorf("could not read docker-compose.yaml: %s", err.Error())
+	}
+
+	preHooks, err := parseHooks(string(composeYAML), HookPreImport)
+	if err != nil {
+		return err
+	}
+	for _, hook := range preHooks {
+		if err := runHook(app, hook); err != nil {
+			return fmt.Errorf("pre-import hook %s failed: %s", hook.Name, err.Error())
+		}
+	}
+
+	if err := importDatabase(app, path.Join(workDir, dbDumpFileName)); err != nil {
+		return fmt.Errorf("could not import database: %s", err.Error())
+	}
+
+	out, err := utils.RunCommand("rsync", []string{
+		"-a", "--delete",
+		path.Join(workDir, filesDirName) + "/",
+		path.Join(basePath, "files") + "/",
+	})
+	if err != nil {
+		return fmt.Errorf("%s - %s", err.Error(), string(out))
+	}
+
+	postHooks, err := parseHooks(string(composeYAML), HookPostImport)
+	if err != nil {
+		return err
+	}
+	for _, hook := range postHooks {
+		if err := runHook(app, hook); err != nil {
+			return fmt.Errorf("post-import hook %s failed: %s", hook.Name, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// runHook executes an AppTypeDriver's Hook inside the app's container for
+// hook.Container, e.g. a search-replace run after restoring a WordPress
+// database.
+func runHook(app App, hook Hook) error {
+	client, err := GetDockerClient()
+	if err != nil {
+		return err
+	}
+
+	exec, err := client.CreateExec(docker.CreateExecOptions{
+		Container:    appContainerName(app, hook.Container),
+		Cmd:          hook.Cmd,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := client.StartExec(exec.ID, docker.StartExecOptions{
+		OutputStream: os.Stdout,
+		ErrorStream:  os.Stderr,
+	}); err != nil {
+		return err
+	}
+
+	return checkExecExitCode(client, exec.ID)
+}
+
+// checkExecExitCode inspects a finished exec and returns an error if it
+// exited non-zero. StartExec only errors when attaching to the exec's
+// streams fails, so callers must check this separately to catch a failing
+// command.
+func checkExecExitCode(client *docker.Client, execID string) error {
+	inspect, err := client.InspectExec(execID)
+	if err != nil {
+		return err
+	}
+
+	if inspect.ExitCode != 0 {
+		return fmt.Errorf("exec exited with code %d", inspect.ExitCode)
+	}
+
+	return nil
+}
+
+// dumpDatabase runs mysqldump inside the app's -db container and writes the
+// gzipped output to a temp file, returning its path. Named return so a
+// flush error on the gzip writer's Close isn't silently dropped, the same
+// class of bug writeBackupTarball guards against.
+func dumpDatabase(app App) (path string, err error) {
+	client, err := GetDockerClient()
+	if err != nil {
+		return "", err
+	}
+
+	containerName := appContainerName(app, "db")
+
+	out, err := os.CreateTemp("", "drud-dbdump-")
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	gzw := gzip.NewWriter(out)
+	defer func() {
+		if cerr := gzw.Close(); cerr != nil && err == nil {
+			err = fmt.Errorf("could not finalize database dump: %s", cerr.Error())
+		}
+	}()
+
+	exec, err := client.CreateExec(docker.CreateExecOptions{
+		Container:    containerName,
+		Cmd:          []string{"mysqldump", "--single-transaction", "data"},
+		AttachStdout: true,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if err = client.StartExec(exec.ID, docker.StartExecOptions{OutputStream: gzw}); err != nil {
+		return "", err
+	}
+
+	if err = checkExecExitCode(client, exec.ID); err != nil {
+		return "", err
+	}
+
+	return out.Name(), nil
+}
+
+// importDatabase pipes a gzipped SQL dump into the app's -db container via
+// the mysql client.
+func importDatabase(app App, dumpPath string) error {
+	client, err := GetDockerClient()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(dumpPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gzr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gzr.Close()
+
+	containerName := appContainerName(app, "db")
+
+	exec, err := client.CreateExec(docker.CreateExecOptions{
+		Container:   containerName,
+		Cmd:         []string{"mysql", "data"},
+		AttachStdin: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := client.StartExec(exec.ID, docker.StartExecOptions{InputStream: gzr}); err != nil {
+		return err
+	}
+
+	return checkExecExitCode(client, exec.ID)
+}
+
+// addFileToTar copies the contents of filePath into the tar writer under name.
+func addFileToTar(tw *tar.Writer, filePath string, name string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// addBytesToTar writes b into the tar writer under name.
+func addBytesToTar(tw *tar.Writer, b []byte, name string) error {
+	hdr := &tar.Header{
+		Name: name,
+		Mode: 0644,
+		Size: int64(len(b)),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(b)
+	return err
+}
+
+// addDirToTar walks dir and writes every regular file into the tar writer,
+// prefixed with prefix.
+func addDirToTar(tw *tar.Writer, dir string, prefix string) error {
+	return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			// filepath.Walk doesn't follow symlinks, so info.IsDir() above
+			// reflects the link itself, not its target - a symlink to a
+			// directory would otherwise reach addFileToTar, which opens it
+			// (following the link) and fails trying to io.Copy a directory
+			// handle, aborting the whole backup. Skip symlinks outright
+			// instead, the same way directories already are.
+			log.Warnf("skipping symlink %s in backup", p)
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		return addFileToTar(tw, p, path.Join(prefix, filepath.ToSlash(rel)))
+	})
+}
+
+// safeJoin joins dir and name the way extractBackup stores a tar entry on
+// disk, rejecting any entry whose cleaned path would escape dir (tar-slip).
+func safeJoin(dir string, name string) (string, error) {
+	joined := path.Join(dir, name)
+	if joined != dir && !strings.HasPrefix(joined, dir+string(os.PathSeparator)) {
+		return "", fmt.Errorf("tar entry %q escapes backup destination", name)
+	}
+	return joined, nil
+}
+
+// extractBackup unpacks a backup tarball into dir and returns its manifest.
+func extractBackup(src string, dir string) (*BackupManifest, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	gzr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer gzr.Close()
+
+	tr := tar.NewReader(gzr)
+
+	var manifest *BackupManifest
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		dest, err := safeJoin(dir, hdr.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := os.MkdirAll(path.Dir(dest), os.FileMode(0774)); err != nil {
+			return nil, err
+		}
+
+		out, err := os.Create(dest)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(out, tr); err != nil {
+			out.Close()
+			return nil, err
+		}
+		out.Close()
+
+		if hdr.Name == manifestFileName {
+			b, err := os.ReadFile(dest)
+			if err != nil {
+				return nil, err
+			}
+			manifest = &BackupManifest{}
+			if err := json.Unmarshal(b, manifest); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if manifest == nil {
+		return nil, fmt.Errorf("backup %s is missing %s", src, manifestFileName)
+	}
+
+	return manifest, nil
+}
+
+// gitCommit returns the current HEAD commit of the git repo at dir, or an
+// empty string if it can't be determined.
+func gitCommit(dir string) string {
+	out, err := utils.RunCommand("git", []string{"-C", dir, "rev-parse", "HEAD"})
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// appIdentity splits an app's RelPath() into its name and environment, the
+// same way container names are derived elsewhere in this package.
+func appIdentity(app App) (name string, environment string) {
+	parts := strings.Split(filepath.ToSlash(app.RelPath()), "/")
+	if len(parts) < 2 {
+		return parts[0], "default"
+	}
+	return parts[len(parts)-2], parts[len(parts)-1]
+}
+
+// appContainerName resolves the docker container name for the given role
+// ("web" or "db") of an app, preferring the label-based registry (see
+// labels.go) and falling back to the legacy "<name>-<environment>-<role>"
+// naming convention if no labeled container is found.
+func appContainerName(app App, role string) string {
+	name, env := appIdentity(app)
+
+	if client, err := GetDockerClient(); err == nil {
+		if containers, err := ListSiteContainers(client); err == nil {
+			matches := LabelFilter(containers, LabelSiteName, name)
+			matches = LabelFilter(matches, LabelEnvironment, env)
+			matches = LabelFilter(matches, LabelRole, role)
+			if len(matches) > 0 {
+				return matches[0].Names[0][1:]
+			}
+		}
+	}
+
+	return name + "-" + env + "-" + role
+}
@@ -0,0 +1,112 @@
+// Package errdefs defines typed errors for the local subsystem so callers
+// can branch on what went wrong (errdefs.IsNotReady(err)) instead of
+// matching substrings in an error's message.
+package errdefs
+
+import "errors"
+
+// ErrNotFound is implemented by errors describing something that does not
+// exist, e.g. an app whose type can't be determined.
+type ErrNotFound interface {
+	NotFound()
+}
+
+// ErrConflict is implemented by errors describing a request that can't be
+// completed because of the current state of things, e.g. a local checkout
+// that already exists.
+type ErrConflict interface {
+	Conflict()
+}
+
+// ErrNotReady is implemented by errors describing a resource that exists
+// but isn't usable yet, e.g. a container whose port hasn't published.
+type ErrNotReady interface {
+	NotReady()
+}
+
+// ErrInvalidConfig is implemented by errors describing configuration that
+// can never succeed no matter how many times it's retried, e.g. a
+// malformed docker host or an unreadable site directory.
+type ErrInvalidConfig interface {
+	InvalidConfig()
+}
+
+// IsNotFound returns true if err, or one of the errors it wraps, is an
+// ErrNotFound.
+func IsNotFound(err error) bool {
+	var target ErrNotFound
+	return errors.As(err, &target)
+}
+
+// IsConflict returns true if err, or one of the errors it wraps, is an
+// ErrConflict.
+func IsConflict(err error) bool {
+	var target ErrConflict
+	return errors.As(err, &target)
+}
+
+// IsNotReady returns true if err, or one of the errors it wraps, is an
+// ErrNotReady.
+func IsNotReady(err error) bool {
+	var target ErrNotReady
+	return errors.As(err, &target)
+}
+
+// IsInvalidConfig returns true if err, or one of the errors it wraps, is an
+// ErrInvalidConfig.
+func IsInvalidConfig(err error) bool {
+	var target ErrInvalidConfig
+	return errors.As(err, &target)
+}
+
+type notFoundError struct{ error }
+
+func (notFoundError) NotFound()       {}
+func (e notFoundError) Unwrap() error { return e.error }
+
+// NotFound wraps err as an ErrNotFound. Returns nil if err is nil.
+func NotFound(err error) error {
+	if err == nil {
+		return nil
+	}
+	return notFoundError{err}
+}
+
+type conflictError struct{ error }
+
+func (conflictError) Conflict()       {}
+func (e conflictError) Unwrap() error { return e.error }
+
+// Conflict wraps err as an ErrConflict. Returns nil if err is nil.
+func Conflict(err error) error {
+	if err == nil {
+		return nil
+	}
+	return conflictError{err}
+}
+
+type notReadyError struct{ error }
+
+func (notReadyError) NotReady()       {}
+func (e notReadyError) Unwrap() error { return e.error }
+
+// NotReady wraps err as an ErrNotReady. Returns nil if err is nil.
+func NotReady(err error) error {
+	if err == nil {
+		return nil
+	}
+	return notReadyError{err}
+}
+
+type invalidConfigError struct{ error }
+
+func (invalidConfigError) InvalidConfig()  {}
+func (e invalidConfigError) Unwrap() error { return e.error }
+
+// InvalidConfig wraps err as an ErrInvalidConfig. Returns nil if err is nil.
+func InvalidConfig(err error) error {
+	if err == nil {
+		return nil
+	}
+	return invalidConfigError{err}
+}
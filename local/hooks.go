@@ -0,0 +1,94 @@
+package local
+
+import (
+	"fmt"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Hook is a named command to run inside one of an app's containers during
+// RestoreApp, e.g. a wp search-replace run after restoring a WordPress
+// database. AppTypeDrivers declare hooks in their ComposeFragment's
+// ddevHooksKey rather than in Go, so they live in the same document as the
+// services they run against.
+type Hook struct {
+	Name      string
+	Container string // RoleWeb or RoleDB
+	Cmd       []string
+}
+
+// HookPhase identifies when a declared hook runs relative to RestoreApp's
+// database import.
+type HookPhase string
+
+const (
+	// HookPreImport hooks run before the database import and before files
+	// are restored, e.g. to put a site into maintenance mode.
+	HookPreImport HookPhase = "pre-import"
+	// HookPostImport hooks run after the database import, e.g. a
+	// search-replace to fix up URLs baked into the dump.
+	HookPostImport HookPhase = "post-import"
+)
+
+// ddevHooksKey is the top-level docker-compose.yaml extension field an
+// AppTypeDriver's ComposeFragment declares its hooks under:
+//
+//	x-ddev-hooks:
+//	  post-import:
+//	    - name: search-replace
+//	      container: web
+//	      cmd: ["wp", "search-replace", "https://old.example", "https://new.example"]
+//
+// parseHooks reads it back out of the rendered docker-compose.yaml.
+const ddevHooksKey = "x-ddev-hooks"
+
+// parseHooks reads the hooks declared for phase out of composeYAML. It
+// returns nil if the app type's ComposeFragment didn't declare ddevHooksKey
+// or has nothing for phase.
+func parseHooks(composeYAML string, phase HookPhase) ([]Hook, error) {
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal([]byte(composeYAML), &doc); err != nil {
+		return nil, err
+	}
+
+	allHooks, ok := doc[ddevHooksKey].(map[interface{}]interface{})
+	if !ok {
+		return nil, nil
+	}
+
+	phaseHooks, ok := allHooks[string(phase)].([]interface{})
+	if !ok {
+		return nil, nil
+	}
+
+	var hooks []Hook
+	for _, raw := range phaseHooks {
+		entry, ok := raw.(map[interface{}]interface{})
+		if !ok {
+			continue
+		}
+
+		var hook Hook
+		if name, ok := entry["name"].(string); ok {
+			hook.Name = name
+		}
+		if container, ok := entry["container"].(string); ok {
+			hook.Container = container
+		}
+		if rawCmd, ok := entry["cmd"].([]interface{}); ok {
+			for _, c := range rawCmd {
+				if s, ok := c.(string); ok {
+					hook.Cmd = append(hook.Cmd, s)
+				}
+			}
+		}
+
+		if hook.Name == "" || hook.Container == "" || len(hook.Cmd) == 0 {
+			return nil, fmt.Errorf("%s: malformed %s entry", ddevHooksKey, phase)
+		}
+
+		hooks = append(hooks, hook)
+	}
+
+	return hooks, nil
+}
@@ -0,0 +1,208 @@
+package local
+
+import (
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Labels ddev writes onto every container at compose-render time (see
+// WriteLocalAppYAML) so listing/filtering subsystems no longer need to
+// reverse-engineer app identity from container names.
+const (
+	LabelSiteName    = "com.ddev.site-name"
+	LabelEnvironment = "com.ddev.environment"
+	LabelRole        = "com.ddev.role"
+	LabelAppType     = "com.ddev.app-type"
+)
+
+// RoleWeb and RoleDB are the values written to LabelRole.
+const (
+	RoleWeb = "web"
+	RoleDB  = "db"
+)
+
+// LabelFilter returns the containers in vs whose label key equals value.
+// Subsystems beyond listing (backup, router, logs) should use this instead
+// of re-parsing container names.
+func LabelFilter(vs []docker.APIContainers, key string, value string) []docker.APIContainers {
+	var vsf []docker.APIContainers
+	for _, v := range vs {
+		if v.Labels[key] == value {
+			vsf = append(vsf, v)
+		}
+	}
+	return vsf
+}
+
+// ListSiteContainers returns every running container ddev manages, i.e.
+// every container carrying a LabelSiteName label.
+func ListSiteContainers(client *docker.Client) ([]docker.APIContainers, error) {
+	return client.ListContainers(docker.ListContainersOptions{
+		All: false,
+		Filters: map[string][]string{
+			"label": {LabelSiteName},
+		},
+	})
+}
+
+// findAppContainer resolves app's role ("web" or "db") container, preferring
+// the label-based registry and falling back to a substring match against
+// the legacy "<site>-<environment>-<role>" naming convention for one
+// release. Unlike splitting a composite container name back into its parts,
+// this works even when siteName itself contains a dash.
+func findAppContainer(client *docker.Client, app App, role string) (docker.APIContainers, bool) {
+	siteName, environment := appIdentity(app)
+
+	containers, err := client.ListContainers(docker.ListContainersOptions{All: false})
+	if err != nil {
+		return docker.APIContainers{}, false
+	}
+
+	matches := LabelFilter(containers, LabelSiteName, siteName)
+	matches = LabelFilter(matches, LabelEnvironment, environment)
+	matches = LabelFilter(matches, LabelRole, role)
+	if len(matches) > 0 {
+		return matches[0], true
+	}
+
+	legacyName := siteName + "-" + environment + "-" + role
+	for _, ctr := range containers {
+		if strings.Contains(ctr.Names[0][1:], legacyName) {
+			return ctr, true
+		}
+	}
+
+	return docker.APIContainers{}, false
+}
+
+// legacyContainerName parses the "legacy-<name>-<env>-<role>" naming
+// convention still produced by containers predating the label-based
+// registry, recognized for one release as a migration path.
+func legacyContainerName(name string) (siteName string, environment string, role string, ok bool) {
+	if !strings.HasPrefix(name, "legacy-") {
+		return "", "", "", false
+	}
+
+	parts := strings.Split(name, "-")
+	if len(parts) != 4 {
+		return "", "", "", false
+	}
+
+	return parts[1], parts[2], parts[3], true
+}
+
+// containerIdentity returns the site name, environment, and role for a
+// container, preferring its com.ddev.* labels and falling back to the
+// legacy dash-delimited name for one release.
+func containerIdentity(v docker.APIContainers) (siteName string, environment string, role string, ok bool) {
+	if v.Labels[LabelSiteName] != "" {
+		return v.Labels[LabelSiteName], v.Labels[LabelEnvironment], v.Labels[LabelRole], true
+	}
+
+	return legacyContainerName(v.Names[0][1:])
+}
+
+// withDDEVLabels merges fragmentYAML (an AppTypeDriver's ComposeFragment,
+// may be "") into composeYAML and stamps the com.ddev.* labels onto every
+// resulting service, unconditionally, so containers carry them from the
+// moment WriteLocalAppYAML first writes the file - not just once
+// DetermineAppType manages to classify the app. appType may be "" if it
+// isn't known yet; in that case com.ddev.app-type is simply omitted.
+//
+// Both documents are parsed and merged before the final yaml.Marshal so a
+// driver contributing its own services (e.g. a search engine sidecar) ends
+// up as part of one valid document instead of two YAML documents
+// concatenated as text.
+func withDDEVLabels(composeYAML string, fragmentYAML string, app App, appType string) (string, error) {
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal([]byte(composeYAML), &doc); err != nil {
+		return "", err
+	}
+
+	if strings.TrimSpace(fragmentYAML) != "" {
+		var fragment map[string]interface{}
+		if err := yaml.Unmarshal([]byte(fragmentYAML), &fragment); err != nil {
+			return "", err
+		}
+		mergeComposeFragment(doc, fragment)
+	}
+
+	services, ok := doc["services"].(map[interface{}]interface{})
+	if !ok {
+		// nothing to label; leave the merged YAML untouched.
+		out, err := yaml.Marshal(doc)
+		if err != nil {
+			return "", err
+		}
+		return string(out), nil
+	}
+
+	siteName, environment := appIdentity(app)
+
+	for role, rawSvc := range services {
+		roleName, ok := role.(string)
+		if !ok {
+			continue
+		}
+
+		svc, ok := rawSvc.(map[interface{}]interface{})
+		if !ok {
+			continue
+		}
+
+		labels, ok := svc["labels"].(map[interface{}]interface{})
+		if !ok {
+			labels = map[interface{}]interface{}{}
+		}
+
+		labels[LabelSiteName] = siteName
+		labels[LabelEnvironment] = environment
+		labels[LabelRole] = roleName
+		if appType != "" {
+			labels[LabelAppType] = appType
+		}
+
+		svc["labels"] = labels
+		services[role] = svc
+	}
+	doc["services"] = services
+
+	out, err := yaml.Marshal(doc)
+	if err != nil {
+		return "", err
+	}
+
+	return string(out), nil
+}
+
+// mergeComposeFragment merges fragment into doc, so an AppTypeDriver's
+// ComposeFragment (its services, and any top-level extension key like
+// ddevHooksKey) becomes part of the same document instead of appended text.
+// "services" is merged service-by-service; every other top-level key (e.g.
+// x-ddev-hooks) is merged wholesale, since only one driver's fragment is
+// ever applied to a given app.
+func mergeComposeFragment(doc map[string]interface{}, fragment map[string]interface{}) {
+	for key, val := range fragment {
+		if key != "services" {
+			doc[key] = val
+			continue
+		}
+
+		fragServices, ok := val.(map[interface{}]interface{})
+		if !ok {
+			continue
+		}
+
+		services, ok := doc["services"].(map[interface{}]interface{})
+		if !ok {
+			services = map[interface{}]interface{}{}
+		}
+
+		for role, svc := range fragServices {
+			services[role] = svc
+		}
+		doc["services"] = services
+	}
+}
@@ -0,0 +1,139 @@
+package local
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/drud/bootstrap/local/errdefs"
+	"github.com/fsouza/go-dockerclient"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// PodReadyTimeout bounds how long GetPodPort will wait for a container to
+// become ready before giving up.
+var PodReadyTimeout = 140 * time.Second
+
+// minReadyBackoff and maxReadyBackoff bound the exponential backoff between
+// readiness checks in GetPodPort.
+const (
+	minReadyBackoff = 250 * time.Millisecond
+	maxReadyBackoff = 5 * time.Second
+)
+
+// GetPodPort waits for app's role ("web" or "db") container to become
+// ready and returns its published port. Readiness prefers the container's
+// Docker HEALTHCHECK status when present, falls back to a raw TCP dial
+// against the published port, and for -db containers additionally issues a
+// SELECT 1 over the mysql protocol before declaring the pod ready.
+func GetPodPort(app App, role string) (int64, error) {
+	client, err := GetDockerClient()
+	if err != nil {
+		return 0, err
+	}
+
+	deadline := time.Now().Add(PodReadyTimeout)
+	backoff := minReadyBackoff
+	var lastErr error
+
+	for {
+		publicPort, portErr := GetPort(app, role)
+		if portErr != nil {
+			lastErr = portErr
+		} else if readyErr := waitPodReady(client, app, role, publicPort); readyErr != nil {
+			lastErr = readyErr
+		} else {
+			return publicPort, nil
+		}
+
+		if errdefs.IsInvalidConfig(lastErr) {
+			return 0, lastErr
+		}
+
+		if time.Now().After(deadline) {
+			return 0, errdefs.NotReady(fmt.Errorf("%s container not ready: %s", appContainerName(app, role), lastErr.Error()))
+		}
+
+		time.Sleep(backoff)
+		if backoff < maxReadyBackoff {
+			backoff *= 2
+			if backoff > maxReadyBackoff {
+				backoff = maxReadyBackoff
+			}
+		}
+	}
+}
+
+// waitPodReady checks whether app's role container, and for -db containers
+// its mysql server, is actually ready to accept traffic on publicPort.
+func waitPodReady(client *docker.Client, app App, role string, publicPort int64) error {
+	ctr, ok := findAppContainer(client, app, role)
+	if !ok {
+		return fmt.Errorf("%s container not found", appContainerName(app, role))
+	}
+
+	inspect, err := client.InspectContainer(ctr.ID)
+	if err != nil {
+		return err
+	}
+
+	if inspect.State.Health != nil && inspect.State.Health.Status != "" {
+		if inspect.State.Health.Status != "healthy" {
+			return fmt.Errorf("container healthcheck status: %s", inspect.State.Health.Status)
+		}
+	} else {
+		conn, err := net.DialTimeout("tcp", "127.0.0.1:"+strconv.FormatInt(publicPort, 10), 2*time.Second)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+	}
+
+	if role == RoleDB {
+		return pingMysql(inspect, publicPort)
+	}
+
+	return nil
+}
+
+// pingMysql issues a SELECT 1 against a -db container's published port
+// using the credentials from its compose environment.
+func pingMysql(inspect *docker.Container, publicPort int64) error {
+	user, pass, rootPass, dbname := "root", "", "", "data"
+	for _, env := range inspect.Config.Env {
+		parts := strings.SplitN(env, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch parts[0] {
+		case "MYSQL_USER":
+			user = parts[1]
+		case "MYSQL_PASSWORD":
+			pass = parts[1]
+		case "MYSQL_ROOT_PASSWORD":
+			rootPass = parts[1]
+		case "MYSQL_DATABASE":
+			dbname = parts[1]
+		}
+	}
+
+	// The official mysql/mariadb images key the root account's password off
+	// MYSQL_ROOT_PASSWORD, reserving MYSQL_USER/MYSQL_PASSWORD for a
+	// separate non-root account.
+	if user == "root" {
+		pass = rootPass
+	}
+
+	dsn := fmt.Sprintf("%s:%s@tcp(127.0.0.1:%d)/%s", user, pass, publicPort, dbname)
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var result int
+	return db.QueryRow("SELECT 1").Scan(&result)
+}
@@ -0,0 +1,326 @@
+package local
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/drud/bootstrap/local/errdefs"
+	"github.com/drud/drud-go/utils"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// routerContainerName is the name of the running router container, used to
+// trigger an in-place nginx reload instead of a docker-compose recreate.
+const routerContainerName = "ddev-router"
+
+// routerSite is what the router needs to route and provision TLS for a
+// site: its identity and the web container currently fronting it.
+type routerSite struct {
+	Name         string
+	Environment  string
+	WebContainer string
+}
+
+// Router is the managed reverse proxy fronting every local site. Unlike the
+// old EnsureDockerRouter, which rewrote router-compose.yaml from a static
+// template and recreated the container on every invocation, Router keeps a
+// routing table of registered sites and can add or remove one with a config
+// rewrite plus an nginx reload - including in response to container events,
+// via Watch, so routes stay current without a docker-compose recreate.
+type Router struct {
+	mu       sync.Mutex
+	client   *docker.Client
+	certDir  string
+	sites    map[string]routerSite // keyed by "<name>-<environment>"
+	watching bool
+
+	// UseMkcert opts into provisioning certs from a locally-trusted mkcert
+	// CA instead of plain self-signed certs.
+	UseMkcert bool
+}
+
+// NewRouter builds a Router against the local docker daemon.
+func NewRouter() (*Router, error) {
+	client, err := GetDockerClient()
+	if err != nil {
+		return nil, err
+	}
+
+	homedir, err := utils.GetHomeDir()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Router{
+		client:  client,
+		certDir: path.Join(homedir, ".drud", "router", "certs"),
+		sites:   map[string]routerSite{},
+	}, nil
+}
+
+// Ensure renders the router's config from the sites currently registered,
+// starts it if it isn't already running, and makes sure Watch is listening
+// for container events so new sites get routed automatically.
+func (r *Router) Ensure() error {
+	r.mu.Lock()
+
+	if err := os.MkdirAll(r.certDir, os.FileMode(0774)); err != nil {
+		r.mu.Unlock()
+		return errdefs.InvalidConfig(err)
+	}
+
+	if err := r.writeConfigLocked(); err != nil {
+		r.mu.Unlock()
+		return err
+	}
+
+	homedir, err := utils.GetHomeDir()
+	if err != nil {
+		r.mu.Unlock()
+		return err
+	}
+
+	out, err := utils.RunCommand("docker-compose", []string{
+		"-f", path.Join(homedir, ".drud", "router-compose.yaml"), "up", "-d",
+	})
+	if err != nil {
+		r.mu.Unlock()
+		return fmt.Errorf("%s - %s", err.Error(), string(out))
+	}
+
+	needsWatch := !r.watching
+	r.watching = true
+	r.mu.Unlock()
+
+	if needsWatch {
+		return r.Watch()
+	}
+
+	return nil
+}
+
+// Register adds app's site to the router's routing table, provisions its
+// TLS cert if needed, and reloads the router. It's idempotent: registering
+// an already-registered app just reloads the config.
+func (r *Router) Register(app App) error {
+	name, env := appIdentity(app)
+
+	return r.registerSite(routerSite{
+		Name:         name,
+		Environment:  env,
+		WebContainer: appContainerName(app, RoleWeb),
+	})
+}
+
+// Deregister removes app's site from the routing table and reloads the
+// router.
+func (r *Router) Deregister(app App) error {
+	name, env := appIdentity(app)
+
+	return r.deregisterSite(name + "-" + env)
+}
+
+// registerSite is the shared implementation behind Register and the
+// container events Watch reacts to.
+func (r *Router) registerSite(site routerSite) error {
+	r.mu.Lock()
+	r.sites[site.Name+"-"+site.Environment] = site
+	r.mu.Unlock()
+
+	if err := r.ensureCert(site.Name); err != nil {
+		return err
+	}
+
+	return r.Reload()
+}
+
+// deregisterSite is the shared implementation behind Deregister and the
+// container events Watch reacts to.
+func (r *Router) deregisterSite(key string) error {
+	r.mu.Lock()
+	delete(r.sites, key)
+	r.mu.Unlock()
+
+	return r.Reload()
+}
+
+// Reload rewrites the router's nginx config and asks the running router
+// container to reload it, without re-running docker-compose.
+func (r *Router) Reload() error {
+	r.mu.Lock()
+	err := r.writeConfigLocked()
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	out, err := utils.RunCommand("docker", []string{"exec", routerContainerName, "nginx", "-s", "reload"})
+	if err != nil {
+		return fmt.Errorf("%s - %s", err.Error(), string(out))
+	}
+
+	return nil
+}
+
+// Watch streams container events from the docker daemon and registers or
+// deregisters a site's web container as it starts or dies, so routes update
+// without a `ddev start`/docker-compose recreate.
+func (r *Router) Watch() error {
+	events := make(chan *docker.APIEvents)
+	if err := r.client.AddEventListener(events); err != nil {
+		return err
+	}
+
+	go func() {
+		for event := range events {
+			if event.Type != "container" {
+				continue
+			}
+
+			site, role, ok := routerSiteFromEvent(event)
+			if !ok || role != RoleWeb {
+				continue
+			}
+
+			switch event.Status {
+			case "start":
+				if err := r.registerSite(site); err != nil {
+					log.Error(err)
+				}
+			case "die":
+				if err := r.deregisterSite(site.Name + "-" + site.Environment); err != nil {
+					log.Error(err)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// routerSiteFromEvent extracts a routerSite and its com.ddev.role label
+// from a container event, using the com.ddev.* labels written by
+// WriteLocalAppYAML (see labels.go) instead of parsing the container name.
+func routerSiteFromEvent(event *docker.APIEvents) (routerSite, string, bool) {
+	if event.Actor.Attributes == nil {
+		return routerSite{}, "", false
+	}
+
+	name := event.Actor.Attributes[LabelSiteName]
+	if name == "" {
+		return routerSite{}, "", false
+	}
+
+	site := routerSite{
+		Name:         name,
+		Environment:  event.Actor.Attributes[LabelEnvironment],
+		WebContainer: event.Actor.Attributes["name"],
+	}
+
+	return site, event.Actor.Attributes[LabelRole], true
+}
+
+// writeConfigLocked renders router-compose.yaml and the per-site nginx
+// vhost config from the currently registered sites. Callers must hold r.mu.
+func (r *Router) writeConfigLocked() error {
+	homedir, err := utils.GetHomeDir()
+	if err != nil {
+		return err
+	}
+
+	composeFile, err := os.Create(path.Join(homedir, ".drud", "router-compose.yaml"))
+	if err != nil {
+		return err
+	}
+	defer composeFile.Close()
+	composeFile.WriteString(fmt.Sprintf(DrudRouterTemplate))
+
+	nginxConf, err := os.Create(path.Join(homedir, ".drud", "router", "nginx.conf"))
+	if err != nil {
+		return err
+	}
+	defer nginxConf.Close()
+
+	fmt.Fprint(nginxConf, nginxConfHeader)
+	for _, site := range r.sites {
+		fmt.Fprintf(nginxConf, vhostTemplate, site.Name, site.Name, site.Name, site.WebContainer)
+	}
+	fmt.Fprint(nginxConf, nginxConfFooter)
+
+	return nil
+}
+
+// ensureCert provisions a per-site certificate in the shared cert
+// directory if one doesn't already exist, using mkcert's locally-trusted CA
+// when UseMkcert is set, otherwise a plain self-signed cert.
+func (r *Router) ensureCert(siteName string) error {
+	domain := siteName + ".ddev.local"
+	certPath := path.Join(r.certDir, domain+".crt")
+	keyPath := path.Join(r.certDir, domain+".key")
+
+	if FileExists(certPath) {
+		return nil
+	}
+
+	if r.UseMkcert {
+		out, err := utils.RunCommand("mkcert", []string{"-cert-file", certPath, "-key-file", keyPath, domain})
+		if err != nil {
+			return fmt.Errorf("%s - %s", err.Error(), string(out))
+		}
+		return nil
+	}
+
+	out, err := utils.RunCommand("openssl", []string{
+		"req", "-x509", "-newkey", "rsa:2048", "-nodes",
+		"-keyout", keyPath,
+		"-out", certPath,
+		"-days", "365",
+		"-subj", "/CN=" + domain,
+	})
+	if err != nil {
+		return fmt.Errorf("%s - %s", err.Error(), string(out))
+	}
+
+	return nil
+}
+
+// nginxConfHeader opens the events{}/http{} blocks this file's server
+// blocks need to parse: nginx rejects bare server{} blocks outside an
+// http{} context, and the router-compose.yaml side of this (DrudRouterTemplate)
+// isn't in scope here to confirm nginx.conf is mounted anywhere other than
+// the container's master config, so writeConfigLocked writes a complete,
+// standalone config rather than assuming an include-fragment setup.
+// writeConfigLocked writes one vhostTemplate server block per registered
+// site between this and nginxConfFooter.
+const nginxConfHeader = `events {
+    worker_connections 1024;
+}
+
+http {
+    include       /etc/nginx/mime.types;
+    default_type  application/octet-stream;
+    sendfile      on;
+`
+
+// nginxConfFooter closes the http{} block opened by nginxConfHeader.
+const nginxConfFooter = `}
+`
+
+// vhostTemplate is a minimal nginx server block routing
+// https://<name>.ddev.local to the labeled web container fronting it.
+const vhostTemplate = `
+server {
+    listen 443 ssl;
+    server_name %s.ddev.local;
+    ssl_certificate     /certs/%s.ddev.local.crt;
+    ssl_certificate_key /certs/%s.ddev.local.key;
+
+    location / {
+        proxy_pass http://%s;
+    }
+}
+`
@@ -5,12 +5,11 @@ import (
 	"os"
 	"path"
 	"strings"
-	"time"
 
 	log "github.com/Sirupsen/logrus"
 
+	"github.com/drud/bootstrap/local/errdefs"
 	"github.com/drud/drud-go/utils"
-	"github.com/drud/drud-go/utils/try"
 	"github.com/fsouza/go-dockerclient"
 	"github.com/gosuri/uitable"
 )
@@ -19,7 +18,7 @@ import (
 func PrepLocalSiteDirs(base string) error {
 	err := os.MkdirAll(base, os.FileMode(int(0774)))
 	if err != nil {
-		return err
+		return errdefs.InvalidConfig(err)
 	}
 
 	dirs := []string{
@@ -30,17 +29,19 @@ func PrepLocalSiteDirs(base string) error {
 	for _, d := range dirs {
 		dirPath := path.Join(base, d)
 		err := os.Mkdir(dirPath, os.FileMode(int(0774)))
-		if err != nil {
-			if !strings.Contains(err.Error(), "file exists") {
-				return err
-			}
+		if err != nil && !os.IsExist(err) {
+			return errdefs.InvalidConfig(err)
 		}
 	}
 
 	return nil
 }
 
-// WriteLocalAppYAML writes docker-compose.yaml to $HOME/.drud/app.Path()
+// WriteLocalAppYAML writes docker-compose.yaml to $HOME/.drud/app.Path().
+// Every service in the rendered file is stamped with the com.ddev.* labels
+// (see withDDEVLabels in labels.go) identifying the site, environment, and
+// role of each service, so listing/filtering no longer has to parse
+// container names.
 func WriteLocalAppYAML(app App) error {
 	homedir, err := utils.GetHomeDir()
 	if err != nil {
@@ -59,6 +60,24 @@ func WriteLocalAppYAML(app App) error {
 	if err != nil {
 		return err
 	}
+
+	// appType may be "" if it can't be determined yet (e.g. src/ hasn't
+	// been cloned). Labels are still stamped on unconditionally below.
+	appType, _ := DetermineAppType(basePath)
+
+	var fragment string
+	if driver, ok := appTypeDrivers[appType]; ok {
+		fragment, err = driver.ComposeFragment(app)
+		if err != nil {
+			return err
+		}
+	}
+
+	rendered, err = withDDEVLabels(rendered, fragment, app, appType)
+	if err != nil {
+		return err
+	}
+
 	f.WriteString(rendered)
 	return nil
 }
@@ -82,25 +101,34 @@ func CloneSource(app App) error {
 
 	basePath := path.Join(homedir, ".drud", app.RelPath(), "src")
 
-	out, err := utils.RunCommand("git", []string{
-		"clone", "-b", details.Branch, coneURL, basePath,
-	})
-	if err != nil {
-		if !strings.Contains(string(out), "already exists") {
-			return fmt.Errorf("%s - %s", err.Error(), string(out))
-		}
-
+	// A prior clone leaves basePath/.git on disk; check for that directly
+	// instead of attempting a clone and matching "already exists" in git's
+	// output to tell the two cases apart.
+	if FileExists(path.Join(basePath, ".git")) {
 		fmt.Print("Local copy of site exists, updating... ")
 
-		out, err = utils.RunCommand("git", []string{
+		out, err := utils.RunCommand("git", []string{
 			"-C", basePath,
 			"pull", "origin", details.Branch,
 		})
 		if err != nil {
-			return fmt.Errorf("%s - %s", err.Error(), string(out))
+			return errdefs.NotReady(fmt.Errorf("%s - %s", err.Error(), string(out)))
 		}
 
 		fmt.Printf("Updated to latest in %s branch\n", details.Branch)
+
+		if len(out) > 0 {
+			log.Info(string(out))
+		}
+
+		return nil
+	}
+
+	out, err := utils.RunCommand("git", []string{
+		"clone", "-b", details.Branch, coneURL, basePath,
+	})
+	if err != nil {
+		return errdefs.NotFound(fmt.Errorf("%s - %s", err.Error(), string(out)))
 	}
 
 	if len(out) > 0 {
@@ -110,57 +138,46 @@ func CloneSource(app App) error {
 	return nil
 }
 
-func GetPort(name string) (int64, error) {
-	client, _ := GetDockerClient()
-	var publicPort int64
-
-	containers, err := client.ListContainers(docker.ListContainersOptions{All: false})
+// GetPort returns the published port of app's role ("web" or "db")
+// container, resolved via the label registry (see findAppContainer in
+// labels.go) instead of matching the composite container name as a
+// substring - a site name containing a dash breaks the latter.
+func GetPort(app App, role string) (int64, error) {
+	client, err := GetDockerClient()
 	if err != nil {
-		return publicPort, err
+		return 0, err
 	}
 
-	for _, ctr := range containers {
-		if strings.Contains(ctr.Names[0][1:], name) {
-			for _, port := range ctr.Ports {
-				if port.PublicPort != 0 {
-					publicPort = port.PublicPort
-					return publicPort, nil
-				}
-			}
-		}
+	ctr, ok := findAppContainer(client, app, role)
+	if !ok {
+		return 0, errdefs.NotReady(fmt.Errorf("%s container not ready", appContainerName(app, role)))
 	}
-	return publicPort, fmt.Errorf("%s container not ready", name)
-}
-
-// GetPodPort clones or pulls a repo
-func GetPodPort(name string) (int64, error) {
-	var publicPort int64
 
-	err := try.Do(func(attempt int) (bool, error) {
-		var err error
-		publicPort, err = GetPort(name)
-		if err != nil {
-			time.Sleep(2 * time.Second) // wait a couple seconds
+	for _, port := range ctr.Ports {
+		if port.PublicPort != 0 {
+			return port.PublicPort, nil
 		}
-		return attempt < 70, err
-	})
-	if err != nil {
-		return publicPort, err
 	}
-
-	return publicPort, nil
+	return 0, errdefs.NotReady(fmt.Errorf("%s container not ready", appContainerName(app, role)))
 }
 
-// GetDockerClient returns a docker client for a docker-machine.
+// GetDockerClient returns a docker client for a docker-machine. Callers get
+// a typed errdefs.ErrInvalidConfig back when the docker endpoint can't be
+// used to build a client, rather than having the process killed out from
+// under them. The daemon isn't contacted here, so an unreachable daemon
+// only shows up as an error from the first call made with the client.
 func GetDockerClient() (*docker.Client, error) {
 	// Create a new docker client talking to the default docker-machine.
 	client, err := docker.NewClient("unix:///var/run/docker.sock")
 	if err != nil {
-		log.Fatal(err)
+		return nil, errdefs.InvalidConfig(err)
 	}
-	return client, err
+	return client, nil
 }
 
+// FilterNonDrud keeps only the containers ddev manages: those carrying a
+// com.ddev.site-name label, or, for one release, a legacy container whose
+// client directory still exists on disk.
 func FilterNonDrud(vs []docker.APIContainers) []docker.APIContainers {
 	homedir, err := utils.GetHomeDir()
 	if err != nil {
@@ -169,6 +186,11 @@ func FilterNonDrud(vs []docker.APIContainers) []docker.APIContainers {
 
 	var vsf []docker.APIContainers
 	for _, v := range vs {
+		if v.Labels[LabelSiteName] != "" {
+			vsf = append(vsf, v)
+			continue
+		}
+
 		clientName := strings.Split(v.Names[0][1:], "-")[0]
 		if _, err = os.Stat(path.Join(homedir, ".drud", clientName)); os.IsNotExist(err) {
 			continue
@@ -236,15 +258,15 @@ func SiteList(containers []docker.APIContainers) error {
 	legacy, local := map[string]LegacyApp{}, map[string]LegacyApp{}
 
 	for _, container := range containers {
-		for _, containerName := range container.Names {
-			if strings.HasPrefix(containerName[1:], "legacy-") {
-				ProcessContainer(legacy, containerName[1:], container)
-				break
-			}
-			if strings.HasSuffix(containerName[1:], "-db") || strings.HasSuffix(containerName[1:], "-web") {
-				ProcessContainer(local, containerName[1:], container)
-				break
-			}
+		siteName, environment, role, ok := containerIdentity(container)
+		if !ok || (role != RoleWeb && role != RoleDB) {
+			continue
+		}
+
+		if strings.HasPrefix(container.Names[0][1:], "legacy-") {
+			ProcessContainer(legacy, siteName, environment, role, container)
+		} else {
+			ProcessContainer(local, siteName, environment, role, container)
 		}
 	}
 
@@ -280,60 +302,39 @@ func RenderAppTable(apps map[string]LegacyApp, name string) {
 }
 
 // ProcessContainer will process a docker container for an app listing.
-// Since apps contain multiple containers, ProcessContainer will be called once per container.
-func ProcessContainer(l map[string]LegacyApp, containerName string, container docker.APIContainers) {
-	parts := strings.Split(containerName, "-")
-
-	if len(parts) == 4 {
-		appid := parts[1] + "-" + parts[2]
-
-		_, exists := l[appid]
-		if exists == false {
-			l[appid] = LegacyApp{
-				Name:        parts[1],
-				Environment: parts[2],
-				Status:      container.State,
-			}
-		}
-		app := l[appid]
-
-		var publicPort int64
-		for _, port := range container.Ports {
-			if port.PublicPort != 0 {
-				publicPort = port.PublicPort
-			}
-		}
-
-		if parts[3] == "web" {
-			app.WebPublicPort = publicPort
-		}
-
-		if parts[3] == "db" {
-			app.DbPublicPort = publicPort
+// Since apps contain multiple containers, ProcessContainer will be called
+// once per container, with siteName/environment/role as resolved by
+// containerIdentity (labels first, legacy names as fallback).
+func ProcessContainer(l map[string]LegacyApp, siteName string, environment string, role string, container docker.APIContainers) {
+	appid := siteName + "-" + environment
+
+	app, exists := l[appid]
+	if !exists {
+		app = LegacyApp{
+			Name:        siteName,
+			Environment: environment,
+			Status:      container.State,
 		}
+	}
 
-		if container.State != "running" {
-			app.Status = container.State
+	var publicPort int64
+	for _, port := range container.Ports {
+		if port.PublicPort != 0 {
+			publicPort = port.PublicPort
 		}
-		l[appid] = app
 	}
-}
 
-// DetermineAppType uses some predetermined file checks to determine if a local app
-// is of any of the known types
-func DetermineAppType(basePath string) (string, error) {
-	defaultLocations := map[string]string{
-		"docroot/scripts/drupal.sh": "drupal",
-		"docroot/wp":                "wp",
+	switch role {
+	case RoleWeb:
+		app.WebPublicPort = publicPort
+	case RoleDB:
+		app.DbPublicPort = publicPort
 	}
 
-	for k, v := range defaultLocations {
-		if FileExists(path.Join(basePath, "src", k)) {
-			return v, nil
-		}
+	if container.State != "running" {
+		app.Status = container.State
 	}
-
-	return "", fmt.Errorf("Couldn't determine app's type!")
+	l[appid] = app
 }
 
 // FileExists checks a file's existence
@@ -347,26 +348,22 @@ func FileExists(name string) bool {
 	return true
 }
 
-// EnsureDockerRouter ensures the router is running.
+// defaultRouter is the shared Router instance used by EnsureDockerRouter,
+// for callers (like `ddev start`) that don't need their own Router.
+var defaultRouter *Router
+
+// EnsureDockerRouter ensures the router is running. See the Router type in
+// router.go for the routing/TLS logic this now delegates to.
 func EnsureDockerRouter() {
-	homeDir, err := utils.GetHomeDir()
-	if err != nil {
-		log.Fatal("could not find home directory")
-	}
-	dest := path.Join(homeDir, ".drud", "router-compose.yaml")
-	f, ferr := os.Create(dest)
-	if ferr != nil {
-		log.Fatal(ferr)
+	if defaultRouter == nil {
+		router, err := NewRouter()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defaultRouter = router
 	}
-	defer f.Close()
-
-	template := fmt.Sprintf(DrudRouterTemplate)
-	f.WriteString(template)
 
-	// run docker-compose up -d in the newly created directory
-	out, err := utils.RunCommand("docker-compose", []string{"-f", dest, "up", "-d"})
-	if err != nil {
-		fmt.Println(fmt.Errorf("%s - %s", err.Error(), string(out)))
+	if err := defaultRouter.Ensure(); err != nil {
+		fmt.Println(err)
 	}
-
 }
\ No newline at end of file